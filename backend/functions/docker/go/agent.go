@@ -1,9 +1,13 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"io"
 	"log"
@@ -12,37 +16,361 @@ import (
 	"os/exec"
 	"path/filepath"
 	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/traefik/yaegi/interp"
 	"github.com/traefik/yaegi/stdlib"
+
+	"github.com/fish-not-phish/FnBox/backend/functions/docker/go/fnbox"
+	"github.com/fish-not-phish/FnBox/backend/functions/docker/go/sandbox"
 )
 
 const (
 	port    = 8080
 	tempDir = "/tmp/go-functions"
-)
 
-var (
-	loadedCode    string
-	handlerName   = "Handler"
-	envVars       = make(map[string]string)
-	useInterpreter = true
+	defaultCacheMaxBytes   = 1 << 30 // 1 GiB
+	defaultCacheMaxEntries = 256
+
+	// defaultRegistryMaxEntries bounds FunctionRegistry the same way
+	// defaultCacheMaxEntries bounds BuildCache: every /invoke call carrying
+	// inline code creates a new entry via loadFunction, and nothing else
+	// evicts them, so an unbounded registry leaks one entry per call.
+	defaultRegistryMaxEntries = 1000
 )
 
+// FunctionEntry holds everything needed to execute one loaded version of a
+// function. Entries are immutable once stored; EnvVars is applied only to
+// that entry's own invocations (see startSandboxedCommand), never to the
+// agent's own process environment, so two resident entries don't clobber
+// each other's env.
+type FunctionEntry struct {
+	Name     string
+	Version  string
+	Code     string
+	Handler  string
+	EnvVars  map[string]string
+	LoadedAt time.Time
+}
+
+// FunctionRegistry keeps every loaded (name, version) pair resident so that
+// concurrent /invoke calls never trample each other's code, handler, or env.
+// It's bounded the same way BuildCache is: once maxEntries is exceeded,
+// Store evicts the oldest entry by LoadedAt, so the still-supported
+// inline-code calling convention (which loads a fresh entry on every call)
+// can't leak entries forever.
+type FunctionRegistry struct {
+	mu         sync.RWMutex
+	entries    map[string]*FunctionEntry // key: name + "@" + version
+	maxEntries int
+}
+
+func NewFunctionRegistry(maxEntries int) *FunctionRegistry {
+	return &FunctionRegistry{
+		entries:    make(map[string]*FunctionEntry),
+		maxEntries: maxEntries,
+	}
+}
+
+func registryKey(name, version string) string {
+	return name + "@" + version
+}
+
+var versionCounter int64
+
+func nextVersion() string {
+	return strconv.FormatInt(atomic.AddInt64(&versionCounter, 1), 10)
+}
+
+func (r *FunctionRegistry) Store(entry *FunctionEntry) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.entries[registryKey(entry.Name, entry.Version)] = entry
+	r.evictLocked()
+}
+
+// evictLocked removes the oldest entry by LoadedAt until the registry is
+// back within maxEntries. Caller must hold r.mu.
+func (r *FunctionRegistry) evictLocked() {
+	for r.maxEntries > 0 && len(r.entries) > r.maxEntries {
+		var oldestKey string
+		var oldest *FunctionEntry
+		for key, entry := range r.entries {
+			if oldest == nil || entry.LoadedAt.Before(oldest.LoadedAt) {
+				oldest = entry
+				oldestKey = key
+			}
+		}
+		if oldest == nil {
+			return
+		}
+		delete(r.entries, oldestKey)
+	}
+}
+
+func (r *FunctionRegistry) Get(name, version string) (*FunctionEntry, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	entry, ok := r.entries[registryKey(name, version)]
+	return entry, ok
+}
+
+// Latest returns the most recently loaded version of name.
+func (r *FunctionRegistry) Latest(name string) (*FunctionEntry, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var latest *FunctionEntry
+	for _, entry := range r.entries {
+		if entry.Name != name {
+			continue
+		}
+		if latest == nil || entry.LoadedAt.After(latest.LoadedAt) {
+			latest = entry
+		}
+	}
+	return latest, latest != nil
+}
+
+func (r *FunctionRegistry) Delete(name, version string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	key := registryKey(name, version)
+	if _, ok := r.entries[key]; !ok {
+		return false
+	}
+	delete(r.entries, key)
+	return true
+}
+
+func (r *FunctionRegistry) Versions(name string) []*FunctionEntry {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var versions []*FunctionEntry
+	for _, entry := range r.entries {
+		if entry.Name == name {
+			versions = append(versions, entry)
+		}
+	}
+	return versions
+}
+
+func (r *FunctionRegistry) List() []*FunctionEntry {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	entries := make([]*FunctionEntry, 0, len(r.entries))
+	for _, entry := range r.entries {
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+var registry = NewFunctionRegistry(registryMaxEntriesFromEnv())
+
+func registryMaxEntriesFromEnv() int {
+	if v := os.Getenv("FNBOX_REGISTRY_MAX_ENTRIES"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			return n
+		}
+	}
+	return defaultRegistryMaxEntries
+}
+
+// buildCacheEntry is one compiled binary resident in the on-disk cache,
+// tracked for LRU eviction.
+type buildCacheEntry struct {
+	hash     string
+	path     string
+	size     int64
+	lastUsed time.Time
+}
+
+// BuildCache is a content-addressed, size- and count-bounded LRU cache of
+// compiled function binaries, keyed by a hash of everything that affects the
+// compiled output. It turns the second and subsequent invocations of the
+// same code into a plain exec, skipping `go build` entirely.
+type BuildCache struct {
+	mu         sync.Mutex
+	dir        string
+	maxBytes   int64
+	maxEntries int
+	totalBytes int64
+	entries    map[string]*buildCacheEntry
+
+	hits   int64
+	misses int64
+}
+
+func NewBuildCache(dir string, maxBytes int64, maxEntries int) *BuildCache {
+	os.MkdirAll(dir, 0755)
+	return &BuildCache{
+		dir:        dir,
+		maxBytes:   maxBytes,
+		maxEntries: maxEntries,
+		entries:    make(map[string]*buildCacheEntry),
+	}
+}
+
+// Get returns the path to the cached binary for hash, if present, bumping it
+// to most-recently-used.
+func (c *BuildCache) Get(hash string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[hash]
+	if !ok {
+		atomic.AddInt64(&c.misses, 1)
+		return "", false
+	}
+
+	entry.lastUsed = time.Now()
+	atomic.AddInt64(&c.hits, 1)
+	return entry.path, true
+}
+
+// Put atomically adopts builtPath (produced by the caller, typically in a
+// scratch exec directory) into the cache under hash, evicting older entries
+// if the configured size or count limits would be exceeded.
+func (c *BuildCache) Put(hash, builtPath string) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if entry, ok := c.entries[hash]; ok {
+		entry.lastUsed = time.Now()
+		return entry.path, nil
+	}
+
+	info, err := os.Stat(builtPath)
+	if err != nil {
+		return "", err
+	}
+
+	entryDir := filepath.Join(c.dir, hash)
+	if err := os.MkdirAll(entryDir, 0755); err != nil {
+		return "", err
+	}
+	finalPath := filepath.Join(entryDir, "function")
+
+	if err := os.Rename(builtPath, finalPath); err != nil {
+		return "", err
+	}
+
+	c.entries[hash] = &buildCacheEntry{
+		hash:     hash,
+		path:     finalPath,
+		size:     info.Size(),
+		lastUsed: time.Now(),
+	}
+	c.totalBytes += info.Size()
+
+	c.evictLocked()
+
+	return finalPath, nil
+}
+
+// evictLocked removes least-recently-used entries until the cache is back
+// within its configured bounds. Caller must hold c.mu.
+func (c *BuildCache) evictLocked() {
+	for c.totalBytes > c.maxBytes || len(c.entries) > c.maxEntries {
+		var oldestHash string
+		var oldest *buildCacheEntry
+		for hash, entry := range c.entries {
+			if oldest == nil || entry.lastUsed.Before(oldest.lastUsed) {
+				oldest = entry
+				oldestHash = hash
+			}
+		}
+		if oldest == nil {
+			return
+		}
+
+		os.RemoveAll(filepath.Join(c.dir, oldestHash))
+		c.totalBytes -= oldest.size
+		delete(c.entries, oldestHash)
+	}
+}
+
+// Purge drops every cached binary and resets size accounting.
+func (c *BuildCache) Purge() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	purged := len(c.entries)
+	os.RemoveAll(c.dir)
+	os.MkdirAll(c.dir, 0755)
+	c.entries = make(map[string]*buildCacheEntry)
+	c.totalBytes = 0
+	return purged
+}
+
+// Stats reports current occupancy and hit/miss counters for /health.
+func (c *BuildCache) Stats() (entries int, bytes int64, hits int64, misses int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.entries), c.totalBytes, atomic.LoadInt64(&c.hits), atomic.LoadInt64(&c.misses)
+}
+
+var buildCache = NewBuildCache(filepath.Join(tempDir, "cache"), cacheMaxBytesFromEnv(), cacheMaxEntriesFromEnv())
+
+func cacheMaxBytesFromEnv() int64 {
+	if v := os.Getenv("FNBOX_CACHE_MAX_BYTES"); v != "" {
+		if n, err := strconv.ParseInt(v, 10, 64); err == nil && n > 0 {
+			return n
+		}
+	}
+	return defaultCacheMaxBytes
+}
+
+func cacheMaxEntriesFromEnv() int {
+	if v := os.Getenv("FNBOX_CACHE_MAX_ENTRIES"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			return n
+		}
+	}
+	return defaultCacheMaxEntries
+}
+
 type LoadRequest struct {
-	Code     string            `json:"code"`
-	Handler  string            `json:"handler"`
-	EnvVars  map[string]string `json:"env_vars"`
+	Name    string            `json:"name"`
+	Code    string            `json:"code"`
+	Handler string            `json:"handler"`
+	EnvVars map[string]string `json:"env_vars"`
+}
+
+type LoadResponse struct {
+	Success bool   `json:"success"`
+	Message string `json:"message"`
+	Name    string `json:"name"`
+	Version string `json:"version"`
 }
 
 type InvokeRequest struct {
+	Name           string                 `json:"name"`
+	Version        string                 `json:"version"`
 	Code           string                 `json:"code"`
 	Handler        string                 `json:"handler"`
 	Event          map[string]interface{} `json:"event"`
 	EnvVars        map[string]string      `json:"env_vars"`
 	TimeoutSeconds int                    `json:"timeout_seconds"`
+	MemoryLimitMb  int64                  `json:"memory_limit_mb"`
+	CpuMillicores  int64                  `json:"cpu_millicores"`
+	MaxPids        int                    `json:"max_pids"`
+}
+
+func (r *InvokeRequest) sandboxLimits() sandbox.Limits {
+	return sandbox.Limits{
+		MemoryLimitMb: r.MemoryLimitMb,
+		CpuMillicores: r.CpuMillicores,
+		MaxPids:       r.MaxPids,
+	}
 }
 
 type ExecutionResult struct {
@@ -54,13 +382,47 @@ type ExecutionResult struct {
 	MemoryUsedMb    int64       `json:"memory_used_mb"`
 }
 
+// sandboxMode is set once at startup from --sandbox and controls how every
+// compiled invocation is isolated.
+var sandboxMode = sandbox.ModeNone
+
+// sandboxExecTargetEnv and sandboxModeEnv drive the re-exec trampoline: the
+// agent binary re-execs itself with these set so that, under ModeFull, the
+// seccomp filter is installed by the process it applies to (a filter can
+// only be installed on the calling process) before it execs into the real
+// compiled function binary, inheriting the same PID for cgroup accounting.
+const (
+	sandboxExecTargetEnv = "FNBOX_SANDBOX_EXEC_TARGET"
+	sandboxModeEnv       = "FNBOX_SANDBOX_MODE"
+)
+
 func main() {
+	if target := os.Getenv(sandboxExecTargetEnv); target != "" {
+		runSandboxTrampoline(target)
+		return
+	}
+
+	sandboxFlag := flag.String("sandbox", string(sandbox.ModeNone), "invocation isolation level: none, cgroup, or full")
+	flag.Parse()
+
+	mode, err := sandbox.ParseMode(*sandboxFlag)
+	if err != nil {
+		log.Fatalf("[AGENT] %v\n", err)
+	}
+	sandboxMode = mode
+
 	// Create temp directory
 	os.MkdirAll(tempDir, 0755)
 
 	http.HandleFunc("/health", healthHandler)
 	http.HandleFunc("/load", loadHandler)
 	http.HandleFunc("/invoke", invokeHandler)
+	http.HandleFunc("/invoke/stream", invokeStreamHandler)
+	http.HandleFunc("/list", listHandler)
+	http.HandleFunc("/delete", deleteHandler)
+	http.HandleFunc("/versions/", versionsHandler)
+	http.HandleFunc("/cache/purge", cachePurgeHandler)
+	http.HandleFunc("/sources", sourcesHandler)
 
 	addr := fmt.Sprintf(":%d", port)
 	log.Printf("[AGENT] Starting Go function execution agent on port %d\n", port)
@@ -71,16 +433,57 @@ func main() {
 	}
 }
 
+// runSandboxTrampoline is the re-exec entrypoint for a ModeFull invocation:
+// it installs the seccomp-bpf filter on itself, then replaces its own image
+// with target via execve so the sandboxed code runs under the same PID the
+// agent already adopted into the invocation's cgroup.
+func runSandboxTrampoline(target string) {
+	if sandbox.Mode(os.Getenv(sandboxModeEnv)) == sandbox.ModeFull {
+		if err := sandbox.InstallSeccompFilter(); err != nil {
+			fmt.Fprintf(os.Stderr, "sandbox: failed to install seccomp filter: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if err := syscall.Exec(target, []string{target}, os.Environ()); err != nil {
+		fmt.Fprintf(os.Stderr, "sandbox: exec %s: %v\n", target, err)
+		os.Exit(1)
+	}
+}
+
 func healthHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
+	entries, bytes, hits, misses := buildCache.Stats()
+
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
 		"status": "healthy",
 		"ready":  true,
+		"cache": map[string]interface{}{
+			"entries": entries,
+			"bytes":   bytes,
+			"hits":    hits,
+			"misses":  misses,
+		},
+	})
+}
+
+func cachePurgeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	purged := buildCache.Purge()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"purged":  purged,
 	})
 }
 
@@ -101,19 +504,23 @@ func loadHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if req.Name == "" {
+		sendError(w, http.StatusBadRequest, "Missing 'name' field")
+		return
+	}
+
 	if req.Handler == "" {
 		req.Handler = "Handler"
 	}
 
-	if err := loadFunction(req.Code, req.Handler, req.EnvVars); err != nil {
-		sendError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to load function: %v", err))
-		return
-	}
+	entry := loadFunction(req.Name, req.Code, req.Handler, req.EnvVars)
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"success": true,
-		"message": "Function loaded",
+	json.NewEncoder(w).Encode(LoadResponse{
+		Success: true,
+		Message: "Function loaded",
+		Name:    entry.Name,
+		Version: entry.Version,
 	})
 }
 
@@ -129,101 +536,229 @@ func invokeHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Support one-shot execution
+	entry, status, errMsg := resolveInvokeEntry(&req)
+	if errMsg != "" {
+		sendError(w, status, errMsg)
+		return
+	}
+
+	result := executeFunction(entry, req.Event, req.TimeoutSeconds, req.sandboxLimits())
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+func invokeStreamHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		sendError(w, http.StatusInternalServerError, "Streaming not supported")
+		return
+	}
+
+	var req InvokeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		sendError(w, http.StatusBadRequest, "Invalid JSON")
+		return
+	}
+
+	entry, status, errMsg := resolveInvokeEntry(&req)
+	if errMsg != "" {
+		sendError(w, status, errMsg)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	// streamFunction drives emit from the metrics ticker and from the
+	// compiled child's stdout/stderr reader goroutines concurrently; without
+	// serializing them, their writes to the shared ResponseWriter can
+	// interleave and corrupt the NDJSON stream.
+	var emitMu sync.Mutex
+	encoder := json.NewEncoder(w)
+	emit := func(frame map[string]interface{}) {
+		emitMu.Lock()
+		defer emitMu.Unlock()
+		encoder.Encode(frame)
+		flusher.Flush()
+	}
+
+	streamFunction(r.Context(), entry, req.Event, req.TimeoutSeconds, req.sandboxLimits(), emit)
+}
+
+// resolveInvokeEntry applies the /invoke and /invoke/stream request
+// semantics: load new code inline when supplied, otherwise look up an
+// already-loaded (name, version) in the registry, defaulting to the latest
+// version and a 30s timeout. Returns a non-empty errMsg on failure.
+func resolveInvokeEntry(req *InvokeRequest) (entry *FunctionEntry, status int, errMsg string) {
 	if req.Code != "" {
+		if req.Name == "" {
+			return nil, http.StatusBadRequest, "Missing 'name' field"
+		}
 		if req.Handler == "" {
 			req.Handler = "Handler"
 		}
-		if err := loadFunction(req.Code, req.Handler, req.EnvVars); err != nil {
-			sendError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to load function: %v", err))
-			return
+		entry = loadFunction(req.Name, req.Code, req.Handler, req.EnvVars)
+	} else {
+		if req.Name == "" {
+			return nil, http.StatusBadRequest, "Missing 'name' field"
+		}
+
+		var ok bool
+		if req.Version != "" {
+			entry, ok = registry.Get(req.Name, req.Version)
+		} else {
+			entry, ok = registry.Latest(req.Name)
+		}
+		if !ok {
+			return nil, http.StatusNotFound, fmt.Sprintf("No loaded function '%s' (version '%s')", req.Name, req.Version)
 		}
 	}
 
 	if req.Event == nil {
 		req.Event = make(map[string]interface{})
 	}
-
 	if req.TimeoutSeconds == 0 {
 		req.TimeoutSeconds = 30
 	}
 
-	result := executeFunction(req.Event, req.TimeoutSeconds)
+	return entry, 0, ""
+}
+
+func listHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	entries := registry.List()
+	summaries := make([]map[string]interface{}, 0, len(entries))
+	for _, entry := range entries {
+		summaries = append(summaries, map[string]interface{}{
+			"name":      entry.Name,
+			"version":   entry.Version,
+			"handler":   entry.Handler,
+			"loaded_at": entry.LoadedAt,
+		})
+	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(result)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"functions": summaries,
+	})
 }
 
-func loadFunction(code, handler string, env map[string]string) error {
-	loadedCode = code
-	handlerName = handler
-	envVars = env
+func deleteHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
 
-	// Set environment variables
-	for key, value := range env {
-		os.Setenv(key, value)
+	var req struct {
+		Name    string `json:"name"`
+		Version string `json:"version"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		sendError(w, http.StatusBadRequest, "Invalid JSON")
+		return
 	}
 
-	// Validate code syntax by trying to parse it
-	// We'll use yaegi interpreter for dynamic execution
-	return nil
+	if req.Name == "" || req.Version == "" {
+		sendError(w, http.StatusBadRequest, "Missing 'name' or 'version' field")
+		return
+	}
+
+	if !registry.Delete(req.Name, req.Version) {
+		sendError(w, http.StatusNotFound, fmt.Sprintf("No loaded function '%s' (version '%s')", req.Name, req.Version))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"message": "Function deleted",
+	})
 }
 
-func executeFunction(event map[string]interface{}, timeoutSeconds int) ExecutionResult {
-	if loadedCode == "" {
-		return ExecutionResult{
-			Success:         false,
-			Error:           "No function code loaded",
-			Logs:            "",
-			ExecutionTimeMs: 0,
-			MemoryUsedMb:    0,
-		}
+func versionsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := strings.TrimPrefix(r.URL.Path, "/versions/")
+	if name == "" {
+		sendError(w, http.StatusBadRequest, "Missing function name in path")
+		return
 	}
 
-	// Capture stdout/stderr
-	var stdoutBuf, stderrBuf bytes.Buffer
-	oldStdout := os.Stdout
-	oldStderr := os.Stderr
+	versions := registry.Versions(name)
+	summaries := make([]map[string]interface{}, 0, len(versions))
+	for _, entry := range versions {
+		summaries = append(summaries, map[string]interface{}{
+			"version":   entry.Version,
+			"handler":   entry.Handler,
+			"loaded_at": entry.LoadedAt,
+		})
+	}
 
-	rOut, wOut, _ := os.Pipe()
-	rErr, wErr, _ := os.Pipe()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"name":     name,
+		"versions": summaries,
+	})
+}
 
-	os.Stdout = wOut
-	os.Stderr = wErr
+func loadFunction(name, code, handler string, env map[string]string) *FunctionEntry {
+	entry := &FunctionEntry{
+		Name:     name,
+		Version:  nextVersion(),
+		Code:     code,
+		Handler:  handler,
+		EnvVars:  env,
+		LoadedAt: time.Now(),
+	}
 
-	// Goroutines to capture output
-	go io.Copy(&stdoutBuf, rOut)
-	go io.Copy(&stderrBuf, rErr)
+	// EnvVars is applied per-invocation (see startSandboxedCommand), not
+	// process-wide, so two resident entries with different env don't
+	// trample each other.
+	registry.Store(entry)
+	return entry
+}
 
+func executeFunction(entry *FunctionEntry, event map[string]interface{}, timeoutSeconds int, limits sandbox.Limits) ExecutionResult {
+	// Logs come back from the compiled child's own stdout/stderr capture
+	// (see runCompiledFunction), not a process-wide os.Stdout/os.Stderr
+	// swap -- with /invoke and event sources now invoking concurrently,
+	// redirecting the agent's own global streams per-invocation would let
+	// one invocation's output bleed into another's.
 	startTime := time.Now()
 	var memStats runtime.MemStats
 	runtime.ReadMemStats(&memStats)
 	startMemory := memStats.Alloc
 
-	// Create context with timeout
-	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(timeoutSeconds)*time.Second)
-	defer cancel()
+	// Build a deadline-carrying context so the compiled handler can observe
+	// its own timeout via FNBOX_DEADLINE_UNIX_NANO.
+	requestID := fmt.Sprintf("req-%d", time.Now().UnixNano())
+	deadline := time.Now().Add(time.Duration(timeoutSeconds) * time.Second)
+	ctx := fnbox.NewContext(context.Background(), deadline, requestID, limits.MemoryLimitMb)
+	defer ctx.Stop()
 
 	// Execute function
-	result, err := executeFunctionWithCompile(ctx, event, timeoutSeconds)
+	outcome, err := executeFunctionWithCompile(ctx, entry, event, timeoutSeconds, limits)
 
 	execTime := time.Since(startTime).Milliseconds()
 
-	// Restore stdout/stderr
-	wOut.Close()
-	wErr.Close()
-	os.Stdout = oldStdout
-	os.Stderr = oldStderr
-
-	time.Sleep(10 * time.Millisecond) // Allow goroutines to finish
-
 	runtime.ReadMemStats(&memStats)
 	endMemory := memStats.Alloc
 
-	stdout := stdoutBuf.String()
-	stderr := stderrBuf.String()
-
-	logs := buildLogs(stdout, stderr)
+	logs := outcome.Logs
 
 	if err != nil {
 		if ctx.Err() == context.DeadlineExceeded {
@@ -232,11 +767,20 @@ func executeFunction(event map[string]interface{}, timeoutSeconds int) Execution
 				Error:           fmt.Sprintf("Function execution exceeded %d seconds", timeoutSeconds),
 				Logs:            logs,
 				ExecutionTimeMs: int64(timeoutSeconds * 1000),
-				MemoryUsedMb:    0,
+				MemoryUsedMb:    outcome.MemoryUsedMb,
+			}
+		}
+
+		if outcome.OOMKilled {
+			return ExecutionResult{
+				Success:         false,
+				Error:           "memory limit exceeded",
+				Logs:            logs,
+				ExecutionTimeMs: execTime,
+				MemoryUsedMb:    outcome.MemoryUsedMb,
 			}
 		}
 
-		logs = buildLogs(stdout, stderr+"\n"+err.Error())
 		return ExecutionResult{
 			Success:         false,
 			Error:           err.Error(),
@@ -246,20 +790,97 @@ func executeFunction(event map[string]interface{}, timeoutSeconds int) Execution
 		}
 	}
 
-	memoryUsed := int64(0)
-	if endMemory > startMemory {
+	memoryUsed := outcome.MemoryUsedMb
+	if memoryUsed == 0 && endMemory > startMemory {
+		// No sandbox accounting available (ModeNone); fall back to the
+		// agent's own allocation delta as a rough estimate.
 		memoryUsed = int64(endMemory-startMemory) / (1024 * 1024)
 	}
 
 	return ExecutionResult{
 		Success:         true,
-		Result:          result,
+		Result:          outcome.Result,
 		Logs:            logs,
 		ExecutionTimeMs: execTime,
 		MemoryUsedMb:    memoryUsed,
 	}
 }
 
+const streamMetricInterval = 500 * time.Millisecond
+
+// streamFunction drives a function invocation the same way executeFunction
+// does, but emits stdout/stderr/metric frames via emit as they happen
+// instead of returning one buffered ExecutionResult. parentCtx is the
+// request's context, so the client disconnecting cancels the child process
+// through the exec.CommandContext in runCompiledFunctionStreaming.
+func streamFunction(parentCtx context.Context, entry *FunctionEntry, event map[string]interface{}, timeoutSeconds int, limits sandbox.Limits, emit func(map[string]interface{})) {
+	requestID := fmt.Sprintf("req-%d", time.Now().UnixNano())
+	deadline := time.Now().Add(time.Duration(timeoutSeconds) * time.Second)
+	ctx := fnbox.NewContext(parentCtx, deadline, requestID, limits.MemoryLimitMb)
+	defer ctx.Stop()
+
+	startTime := time.Now()
+
+	metricsDone := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(streamMetricInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				var memStats runtime.MemStats
+				runtime.ReadMemStats(&memStats)
+				emit(map[string]interface{}{
+					"type":       "metric",
+					"mem_mb":     int64(memStats.Alloc / (1024 * 1024)),
+					"elapsed_ms": time.Since(startTime).Milliseconds(),
+				})
+			case <-metricsDone:
+				return
+			}
+		}
+	}()
+
+	outcome, err := executeFunctionWithCompileStreaming(ctx, entry, event, timeoutSeconds, limits, emit)
+	close(metricsDone)
+
+	elapsedMs := time.Since(startTime).Milliseconds()
+
+	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			emit(map[string]interface{}{
+				"type":       "error",
+				"error":      fmt.Sprintf("Function execution exceeded %d seconds", timeoutSeconds),
+				"elapsed_ms": elapsedMs,
+			})
+			return
+		}
+
+		if outcome.OOMKilled {
+			emit(map[string]interface{}{
+				"type":       "error",
+				"error":      "memory limit exceeded",
+				"elapsed_ms": elapsedMs,
+			})
+			return
+		}
+
+		emit(map[string]interface{}{
+			"type":       "error",
+			"error":      err.Error(),
+			"elapsed_ms": elapsedMs,
+		})
+		return
+	}
+
+	emit(map[string]interface{}{
+		"type":       "result",
+		"result":     outcome.Result,
+		"elapsed_ms": elapsedMs,
+		"mem_mb":     outcome.MemoryUsedMb,
+	})
+}
+
 // cleanUserCode removes package declarations and extracts imports from user code
 func cleanUserCode(code string) (cleanedCode string, imports []string) {
 	lines := strings.Split(code, "\n")
@@ -310,7 +931,26 @@ func cleanUserCode(code string) (cleanedCode string, imports []string) {
 	return cleanedCode, imports
 }
 
-func executeFunctionWithInterpreter(ctx context.Context, event map[string]interface{}, timeoutSeconds int) (interface{}, error) {
+// buildImportBlock renders an import set as a Go import block, sorting the
+// lines first so that identical import sets always render identically --
+// ranging over a map directly would otherwise randomize the order and make
+// buildCacheKey miss on code that hasn't actually changed.
+func buildImportBlock(imports map[string]bool) string {
+	lines := make([]string, 0, len(imports))
+	for imp := range imports {
+		lines = append(lines, imp)
+	}
+	sort.Strings(lines)
+
+	importBlock := "import (\n"
+	for _, imp := range lines {
+		importBlock += "\t" + imp + "\n"
+	}
+	importBlock += ")\n"
+	return importBlock
+}
+
+func executeFunctionWithInterpreter(ctx context.Context, entry *FunctionEntry, event map[string]interface{}, timeoutSeconds int) (interface{}, error) {
 	// Use yaegi interpreter for dynamic Go code execution
 	i := interp.New(interp.Options{})
 
@@ -318,7 +958,7 @@ func executeFunctionWithInterpreter(ctx context.Context, event map[string]interf
 	i.Use(stdlib.Symbols)
 
 	// Clean user code and extract imports
-	cleanedCode, userImports := cleanUserCode(loadedCode)
+	cleanedCode, userImports := cleanUserCode(entry.Code)
 
 	// Build import list (include user imports)
 	defaultImports := []string{`"encoding/json"`, `"fmt"`, `"os"`}
@@ -331,11 +971,7 @@ func executeFunctionWithInterpreter(ctx context.Context, event map[string]interf
 	}
 
 	// Build import block
-	importBlock := "import (\n"
-	for imp := range allImports {
-		importBlock += "\t" + imp + "\n"
-	}
-	importBlock += ")\n"
+	importBlock := buildImportBlock(allImports)
 
 	// Prepare the code with package and imports
 	fullCode := "package main\n\n" + importBlock + "\n" + cleanedCode
@@ -346,9 +982,9 @@ func executeFunctionWithInterpreter(ctx context.Context, event map[string]interf
 	}
 
 	// Get the handler function
-	handlerVal, err := i.Eval("main." + handlerName)
+	handlerVal, err := i.Eval("main." + entry.Handler)
 	if err != nil {
-		return nil, fmt.Errorf("handler function '%s' not found: %v", handlerName, err)
+		return nil, fmt.Errorf("handler function '%s' not found: %v", entry.Handler, err)
 	}
 
 	// Create context map
@@ -382,7 +1018,7 @@ func executeFunctionWithInterpreter(ctx context.Context, event map[string]interf
 
 		// We need to call the function with proper types
 		// This is a simplified approach - in production, use reflection more carefully
-		result, err := callHandlerFunction(handler, eventJSON, contextJSON)
+		result, err := callHandlerFunction(ctx, handler, eventJSON, contextJSON)
 		resultChan <- execResult{result: result, err: err}
 	}()
 
@@ -394,7 +1030,7 @@ func executeFunctionWithInterpreter(ctx context.Context, event map[string]interf
 	}
 }
 
-func callHandlerFunction(handler interface{}, eventJSON, contextJSON []byte) (interface{}, error) {
+func callHandlerFunction(ctx context.Context, handler interface{}, eventJSON, contextJSON []byte) (interface{}, error) {
 	// This is a simplified call - in production, use proper reflection
 	// to handle different function signatures
 
@@ -402,15 +1038,30 @@ func callHandlerFunction(handler interface{}, eventJSON, contextJSON []byte) (in
 	// and captures the result
 
 	var event map[string]interface{}
-	var context map[string]interface{}
+	var evtContext map[string]interface{}
 	json.Unmarshal(eventJSON, &event)
-	json.Unmarshal(contextJSON, &context)
+	json.Unmarshal(contextJSON, &evtContext)
 
 	// Try to execute as a simple function that returns string or interface{}
 	switch fn := handler.(type) {
+	// context.Context-aware signatures, for handlers that want to observe
+	// ctx.Deadline() themselves instead of trusting FnBox's own timeout.
+	case func(context.Context, map[string]interface{}) (interface{}, error):
+		return fn(ctx, event)
+	case func(context.Context, json.RawMessage) (json.RawMessage, error):
+		raw, err := fn(ctx, json.RawMessage(eventJSON))
+		if err != nil {
+			return nil, err
+		}
+		var result interface{}
+		if err := json.Unmarshal(raw, &result); err != nil {
+			return string(raw), nil
+		}
+		return result, nil
+
 	// Functions returning (interface{}, error)
 	case func(map[string]interface{}, map[string]interface{}) (interface{}, error):
-		return fn(event, context)
+		return fn(event, evtContext)
 	case func(map[string]interface{}) (interface{}, error):
 		return fn(event)
 	case func(interface{}) (interface{}, error):
@@ -420,7 +1071,7 @@ func callHandlerFunction(handler interface{}, eventJSON, contextJSON []byte) (in
 
 	// Functions returning interface{} without error
 	case func(map[string]interface{}, map[string]interface{}) interface{}:
-		result := fn(event, context)
+		result := fn(event, evtContext)
 		return result, nil
 	case func(map[string]interface{}) interface{}:
 		result := fn(event)
@@ -428,7 +1079,7 @@ func callHandlerFunction(handler interface{}, eventJSON, contextJSON []byte) (in
 
 	// Functions returning map[string]interface{} (common pattern)
 	case func(map[string]interface{}, map[string]interface{}) map[string]interface{}:
-		result := fn(event, context)
+		result := fn(event, evtContext)
 		return result, nil
 	case func(map[string]interface{}) map[string]interface{}:
 		result := fn(event)
@@ -436,7 +1087,7 @@ func callHandlerFunction(handler interface{}, eventJSON, contextJSON []byte) (in
 
 	// Functions returning string
 	case func(map[string]interface{}, map[string]interface{}) string:
-		result := fn(event, context)
+		result := fn(event, evtContext)
 		return result, nil
 	case func(map[string]interface{}) string:
 		result := fn(event)
@@ -490,18 +1141,28 @@ func sendError(w http.ResponseWriter, statusCode int, message string) {
 	})
 }
 
-// Alternative: Compile and execute as plugin (more complex, requires proper Go module setup)
-func executeFunctionWithCompile(ctx context.Context, event map[string]interface{}, timeoutSeconds int) (interface{}, error) {
-	// Create temporary directory for this execution
-	execDir := filepath.Join(tempDir, fmt.Sprintf("exec_%d", time.Now().UnixNano()))
-	os.MkdirAll(execDir, 0755)
-	defer os.RemoveAll(execDir)
-
+// resultFrameMarker prefixes the line a compiled function's wrapper main()
+// prints its JSON result on, so a streaming reader can tell the result line
+// apart from whatever the handler itself writes to stdout.
+const resultFrameMarker = "\x1efnbox-result\x1e"
+
+// errorFrameMarker prefixes the line a compiled function's wrapper main()
+// prints a handler-returned error on, in place of resultFrameMarker, so the
+// error propagates back as ExecutionResult.Error instead of being swallowed
+// as an empty successful result.
+const errorFrameMarker = "\x1efnbox-error\x1e"
+
+// prepareCompiledBinary returns the path to a compiled binary for entry,
+// either reused from the build cache or freshly compiled and adopted into
+// it. The returned binary reads its event from the EVENT env var and its
+// timeout from FNBOX_TIMEOUT_SECONDS, and prints its result prefixed with
+// resultFrameMarker.
+func prepareCompiledBinary(ctx context.Context, entry *FunctionEntry) (string, error) {
 	// Clean user code and extract imports
-	cleanedCode, userImports := cleanUserCode(loadedCode)
+	cleanedCode, userImports := cleanUserCode(entry.Code)
 
 	// Build import list
-	defaultImports := []string{`"encoding/json"`, `"fmt"`, `"os"`}
+	defaultImports := []string{`"context"`, `"encoding/json"`, `"fmt"`, `"os"`, `"reflect"`, `"time"`}
 	allImports := make(map[string]bool)
 	for _, imp := range defaultImports {
 		allImports[imp] = true
@@ -511,16 +1172,27 @@ func executeFunctionWithCompile(ctx context.Context, event map[string]interface{
 	}
 
 	// Build import block
-	importBlock := "import (\n"
-	for imp := range allImports {
-		importBlock += "\t" + imp + "\n"
+	importBlock := buildImportBlock(allImports)
+
+	// Resolve go.mod/go.sum content up front so it can feed the cache key
+	// before we decide whether a build is even necessary.
+	goModContent, goSumContent := resolveFunctionModFiles()
+
+	cacheKey := buildCacheKey(cleanedCode, importBlock, entry.Handler, goModContent, goSumContent)
+
+	if binaryPath, ok := buildCache.Get(cacheKey); ok {
+		return binaryPath, nil
 	}
-	importBlock += ")\n"
 
-	// Write function code to file
-	functionFile := filepath.Join(execDir, "function.go")
+	// Create temporary directory for this build
+	execDir := filepath.Join(tempDir, fmt.Sprintf("exec_%d", time.Now().UnixNano()))
+	os.MkdirAll(execDir, 0755)
+	defer os.RemoveAll(execDir)
 
-	// Wrap code in proper package structure
+	// Wrap code in proper package structure. timeout_seconds is read from an
+	// env var rather than baked into the source so that the compiled binary
+	// -- and therefore its cache entry -- doesn't change across invocations
+	// that only differ in timeout.
 	fullCode := fmt.Sprintf(`package main
 
 %s
@@ -535,33 +1207,65 @@ func main() {
 		json.Unmarshal([]byte(eventStr), &event)
 	}
 
-	context := map[string]interface{}{
-		"timeout_seconds": %d,
+	timeoutSeconds := 0
+	fmt.Sscanf(os.Getenv("FNBOX_TIMEOUT_SECONDS"), "%%d", &timeoutSeconds)
+
+	// Build a ctx carrying the same deadline the agent enforces from
+	// outside, for handlers written to observe it themselves.
+	ctx := context.Background()
+	if deadlineStr := os.Getenv("FNBOX_DEADLINE_UNIX_NANO"); deadlineStr != "" {
+		var deadlineNano int64
+		fmt.Sscanf(deadlineStr, "%%d", &deadlineNano)
+		if deadlineNano > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithDeadline(ctx, time.Unix(0, deadlineNano))
+			defer cancel()
+		}
+	}
+
+	fnContext := map[string]interface{}{
+		"timeout_seconds": timeoutSeconds,
+	}
+
+	var result interface{}
+	var fnErr error
+	switch fn := interface{}(%s).(type) {
+	case func(context.Context, map[string]interface{}) (interface{}, error):
+		result, fnErr = fn(ctx, event)
+	case func(context.Context, json.RawMessage) (json.RawMessage, error):
+		eventJSON, _ := json.Marshal(event)
+		var raw json.RawMessage
+		raw, fnErr = fn(ctx, eventJSON)
+		if fnErr == nil {
+			json.Unmarshal(raw, &result)
+		}
+	default:
+		// Called through reflect so this branch still type-checks when the
+		// handler has one of the context-aware signatures above.
+		out := reflect.ValueOf(fn).Call([]reflect.Value{reflect.ValueOf(event), reflect.ValueOf(fnContext)})
+		result = out[0].Interface()
+	}
+
+	if fnErr != nil {
+		fmt.Println(%q + fnErr.Error())
+		return
 	}
 
-	result := %s(event, context)
 	output, _ := json.Marshal(result)
-	fmt.Println(string(output))
+	fmt.Println(%q + string(output))
 }
-`, importBlock, cleanedCode, timeoutSeconds, handlerName)
+`, importBlock, cleanedCode, entry.Handler, errorFrameMarker, resultFrameMarker)
 
+	functionFile := filepath.Join(execDir, "function.go")
 	if err := os.WriteFile(functionFile, []byte(fullCode), 0644); err != nil {
-		return nil, fmt.Errorf("failed to write function file: %v", err)
+		return "", fmt.Errorf("failed to write function file: %v", err)
 	}
 
-	// Initialize go.mod if /packages/go.mod exists (has dependencies)
-	packagesModPath := "/packages/go.mod"
-	if _, err := os.Stat(packagesModPath); err == nil {
-		// Copy go.mod and go.sum from /packages
-		exec.CommandContext(ctx, "cp", packagesModPath, filepath.Join(execDir, "go.mod")).Run()
-		packagesSumPath := "/packages/go.sum"
-		if _, err := os.Stat(packagesSumPath); err == nil {
-			exec.CommandContext(ctx, "cp", packagesSumPath, filepath.Join(execDir, "go.sum")).Run()
-		}
-	} else {
-		// No dependencies, create a simple go.mod
-		goModContent := "module function\n\ngo 1.25\n"
-		os.WriteFile(filepath.Join(execDir, "go.mod"), []byte(goModContent), 0644)
+	if err := os.WriteFile(filepath.Join(execDir, "go.mod"), []byte(goModContent), 0644); err != nil {
+		return "", fmt.Errorf("failed to write go.mod: %v", err)
+	}
+	if goSumContent != "" {
+		os.WriteFile(filepath.Join(execDir, "go.sum"), []byte(goSumContent), 0644)
 	}
 
 	// Compile the function
@@ -580,24 +1284,295 @@ func main() {
 	cmd.Env = env
 
 	if output, err := cmd.CombinedOutput(); err != nil {
-		return nil, fmt.Errorf("compilation failed: %v\n%s", err, output)
+		return "", fmt.Errorf("compilation failed: %v\n%s", err, output)
+	}
+
+	cachedPath, err := buildCache.Put(cacheKey, binaryFile)
+	if err != nil {
+		// Cache adoption failed (e.g. cross-device rename); fall back to
+		// executing straight out of the scratch directory. The exec dir is
+		// about to be removed by the deferred cleanup above, so copy the
+		// binary out first.
+		fallbackPath := filepath.Join(tempDir, fmt.Sprintf("fallback_%d", time.Now().UnixNano()))
+		if data, readErr := os.ReadFile(binaryFile); readErr == nil {
+			os.WriteFile(fallbackPath, data, 0755)
+			cachedPath = fallbackPath
+		} else {
+			return "", err
+		}
+	}
+
+	return cachedPath, nil
+}
+
+// compileOutcome is the result of running a compiled function binary,
+// including the sandbox accounting that replaces the agent's own (and
+// meaningless) MemStats-based guess.
+type compileOutcome struct {
+	Result       interface{}
+	Logs         string
+	MemoryUsedMb int64
+	OOMKilled    bool
+}
+
+// Alternative: Compile and execute as plugin (more complex, requires proper Go module setup)
+func executeFunctionWithCompile(ctx context.Context, entry *FunctionEntry, event map[string]interface{}, timeoutSeconds int, limits sandbox.Limits) (compileOutcome, error) {
+	binaryPath, err := prepareCompiledBinary(ctx, entry)
+	if err != nil {
+		return compileOutcome{}, err
+	}
+
+	return runCompiledFunction(ctx, binaryPath, event, timeoutSeconds, limits, entry.EnvVars)
+}
+
+// executeFunctionWithCompileStreaming is the streaming counterpart of
+// executeFunctionWithCompile: it shares the same cached-binary preparation
+// but tees the child's stdout/stderr to emit as they're produced instead of
+// buffering until the process exits.
+func executeFunctionWithCompileStreaming(ctx context.Context, entry *FunctionEntry, event map[string]interface{}, timeoutSeconds int, limits sandbox.Limits, emit func(map[string]interface{})) (compileOutcome, error) {
+	binaryPath, err := prepareCompiledBinary(ctx, entry)
+	if err != nil {
+		return compileOutcome{}, err
+	}
+
+	return runCompiledFunctionStreaming(ctx, binaryPath, event, timeoutSeconds, limits, entry.EnvVars, emit)
+}
+
+// resolveFunctionModFiles returns the go.mod/go.sum contents that will be
+// used for a compiled invocation, mirroring the /packages dependency set
+// when present so the cache key reflects the real build inputs.
+func resolveFunctionModFiles() (goMod string, goSum string) {
+	if data, err := os.ReadFile("/packages/go.mod"); err == nil {
+		goMod = string(data)
+		if sum, err := os.ReadFile("/packages/go.sum"); err == nil {
+			goSum = string(sum)
+		}
+		return goMod, goSum
 	}
 
-	// Execute the compiled binary
-	cmd = exec.CommandContext(ctx, binaryFile)
+	return "module function\n\ngo 1.25\n", ""
+}
+
+// buildCacheKey hashes everything that affects the compiled binary so that
+// identical code, handler, dependencies, and toolchain reuse the same
+// cache entry.
+func buildCacheKey(cleanedCode, importBlock, handler, goMod, goSum string) string {
+	h := sha256.New()
+	io.WriteString(h, cleanedCode)
+	io.WriteString(h, importBlock)
+	io.WriteString(h, handler)
+	io.WriteString(h, goMod)
+	io.WriteString(h, goSum)
+	io.WriteString(h, runtime.GOARCH)
+	io.WriteString(h, runtime.GOOS)
+	io.WriteString(h, runtime.Version())
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// startSandboxedCommand builds the *exec.Cmd for one invocation of
+// binaryPath under sandboxMode and prepares its cgroup. Under ModeFull the
+// command is actually the agent re-execing itself (see
+// runSandboxTrampoline) so it can install a seccomp filter on itself before
+// taking on the user binary's image, while keeping the same PID the caller
+// will adopt into the cgroup. The caller must set Stdout/Stderr, Start the
+// command, Adopt() the resulting PID, and Cleanup() the sandbox when done.
+func startSandboxedCommand(ctx context.Context, binaryPath string, event map[string]interface{}, timeoutSeconds int, limits sandbox.Limits, envVars map[string]string) (*exec.Cmd, *sandbox.Sandbox, error) {
+	execID := fmt.Sprintf("%d", time.Now().UnixNano())
+	sbox := sandbox.New(sandboxMode, execID, limits)
+	if err := sbox.Prepare(); err != nil {
+		return nil, nil, fmt.Errorf("sandbox setup failed: %w", err)
+	}
+
+	// Build the child's env from scratch rather than inheriting the agent's
+	// own environment -- a sandboxed invocation should see only what its
+	// entry was loaded with plus FnBox's own calling convention, not every
+	// other loaded function's secrets or the agent process's own env.
 	eventJSON, _ := json.Marshal(event)
-	cmd.Env = append(os.Environ(), "EVENT="+string(eventJSON))
+	env := []string{
+		"EVENT=" + string(eventJSON),
+		"FNBOX_TIMEOUT_SECONDS=" + strconv.Itoa(timeoutSeconds),
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		env = append(env, "FNBOX_DEADLINE_UNIX_NANO="+strconv.FormatInt(deadline.UnixNano(), 10))
+	}
+	for key, value := range envVars {
+		env = append(env, key+"="+value)
+	}
+
+	var cmd *exec.Cmd
+	if sbox.Mode == sandbox.ModeFull {
+		self, err := os.Executable()
+		if err != nil {
+			sbox.Cleanup()
+			return nil, nil, fmt.Errorf("sandbox: resolving agent binary: %w", err)
+		}
+		cmd = exec.CommandContext(ctx, self)
+		env = append(env, sandboxExecTargetEnv+"="+binaryPath, sandboxModeEnv+"="+string(sandbox.ModeFull))
+	} else {
+		cmd = exec.CommandContext(ctx, binaryPath)
+	}
+	cmd.Env = env
+
+	return cmd, sbox, nil
+}
+
+// adoptSandboxedStart starts cmd and, once its PID is known, moves it into
+// sbox's cgroup. Killing the process on a failed adopt avoids leaving an
+// unconstrained child running outside its requested limits.
+func adoptSandboxedStart(cmd *exec.Cmd, sbox *sandbox.Sandbox) error {
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start function: %v", err)
+	}
+
+	if err := sbox.Adopt(cmd.Process.Pid); err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return fmt.Errorf("sandbox: adopting process: %w", err)
+	}
+
+	return nil
+}
+
+// runCompiledFunction execs a previously-built function binary (cached or
+// freshly compiled) and parses its stdout as the invocation result.
+func runCompiledFunction(ctx context.Context, binaryPath string, event map[string]interface{}, timeoutSeconds int, limits sandbox.Limits, envVars map[string]string) (compileOutcome, error) {
+	cmd, sbox, err := startSandboxedCommand(ctx, binaryPath, event, timeoutSeconds, limits, envVars)
+	if err != nil {
+		return compileOutcome{}, err
+	}
+	defer sbox.Cleanup()
+
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+
+	if err := adoptSandboxedStart(cmd, sbox); err != nil {
+		return compileOutcome{}, err
+	}
+
+	waitErr := cmd.Wait()
+
+	memoryUsedMb, _ := sbox.PeakMemoryMb()
+	if sbox.OOMKilled() {
+		return compileOutcome{MemoryUsedMb: memoryUsedMb, OOMKilled: true}, fmt.Errorf("memory limit exceeded")
+	}
 
-	output, err := cmd.CombinedOutput()
+	if waitErr != nil {
+		return compileOutcome{Logs: buildLogs(output.String(), "")}, fmt.Errorf("execution failed: %v\n%s", waitErr, output.Bytes())
+	}
+
+	logsPart, resultPart, errPart := splitResultFrame(output.String())
+
+	if errPart != "" {
+		return compileOutcome{Logs: buildLogs(logsPart, ""), MemoryUsedMb: memoryUsedMb}, fmt.Errorf("%s", errPart)
+	}
+
+	var result interface{}
+	if err := json.Unmarshal([]byte(resultPart), &result); err != nil {
+		result = resultPart
+	}
+
+	return compileOutcome{Result: result, Logs: buildLogs(logsPart, ""), MemoryUsedMb: memoryUsedMb}, nil
+}
+
+// splitResultFrame separates a compiled function's combined stdout/stderr
+// into the preceding log output and whichever frame the wrapper main()
+// printed last: a resultFrameMarker-prefixed line (returned via result, for
+// callers to json.Unmarshal) or an errorFrameMarker-prefixed line (returned
+// via errMsg, when the handler itself returned a non-nil error).
+func splitResultFrame(raw string) (logs string, result string, errMsg string) {
+	if idx := strings.LastIndex(raw, errorFrameMarker); idx != -1 {
+		return raw[:idx], "", strings.TrimSpace(raw[idx+len(errorFrameMarker):])
+	}
+	idx := strings.LastIndex(raw, resultFrameMarker)
+	if idx == -1 {
+		return raw, strings.TrimSpace(raw), ""
+	}
+	return raw[:idx], strings.TrimSpace(raw[idx+len(resultFrameMarker):]), ""
+}
+
+// runCompiledFunctionStreaming execs a compiled function binary and emits
+// each stdout/stderr line as a frame via emit as soon as it's produced,
+// instead of buffering until the process exits. The final line (marked with
+// resultFrameMarker by the wrapper main()) is parsed as the return value.
+func runCompiledFunctionStreaming(ctx context.Context, binaryPath string, event map[string]interface{}, timeoutSeconds int, limits sandbox.Limits, envVars map[string]string, emit func(map[string]interface{})) (compileOutcome, error) {
+	cmd, sbox, err := startSandboxedCommand(ctx, binaryPath, event, timeoutSeconds, limits, envVars)
+	if err != nil {
+		return compileOutcome{}, err
+	}
+	defer sbox.Cleanup()
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return compileOutcome{}, fmt.Errorf("failed to attach stdout: %v", err)
+	}
+	stderr, err := cmd.StderrPipe()
 	if err != nil {
-		return nil, fmt.Errorf("execution failed: %v\n%s", err, output)
+		return compileOutcome{}, fmt.Errorf("failed to attach stderr: %v", err)
+	}
+
+	if err := adoptSandboxedStart(cmd, sbox); err != nil {
+		return compileOutcome{}, err
 	}
 
-	// Parse result
 	var result interface{}
-	if err := json.Unmarshal(output, &result); err != nil {
-		return string(output), nil
+	var resultFound bool
+	var handlerErr string
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	go func() {
+		defer wg.Done()
+		scanner := bufio.NewScanner(stdout)
+		scanner.Buffer(make([]byte, 0, 64*1024), 4*1024*1024)
+		for scanner.Scan() {
+			line := scanner.Text()
+			if strings.HasPrefix(line, errorFrameMarker) {
+				handlerErr = strings.TrimPrefix(line, errorFrameMarker)
+				continue
+			}
+			if strings.HasPrefix(line, resultFrameMarker) {
+				payload := strings.TrimPrefix(line, resultFrameMarker)
+				if err := json.Unmarshal([]byte(payload), &result); err != nil {
+					result = payload
+				}
+				resultFound = true
+				continue
+			}
+			emit(map[string]interface{}{"type": "stdout", "data": line})
+		}
+	}()
+
+	go func() {
+		defer wg.Done()
+		scanner := bufio.NewScanner(stderr)
+		scanner.Buffer(make([]byte, 0, 64*1024), 4*1024*1024)
+		for scanner.Scan() {
+			emit(map[string]interface{}{"type": "stderr", "data": scanner.Text()})
+		}
+	}()
+
+	wg.Wait()
+
+	waitErr := cmd.Wait()
+
+	memoryUsedMb, _ := sbox.PeakMemoryMb()
+	if sbox.OOMKilled() {
+		return compileOutcome{MemoryUsedMb: memoryUsedMb, OOMKilled: true}, fmt.Errorf("memory limit exceeded")
+	}
+
+	if waitErr != nil {
+		return compileOutcome{}, fmt.Errorf("execution failed: %v", waitErr)
+	}
+
+	if handlerErr != "" {
+		return compileOutcome{MemoryUsedMb: memoryUsedMb}, fmt.Errorf("%s", handlerErr)
+	}
+
+	if !resultFound {
+		return compileOutcome{}, fmt.Errorf("function did not produce a result")
 	}
 
-	return result, nil
+	return compileOutcome{Result: result, MemoryUsedMb: memoryUsedMb}, nil
 }
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/robfig/cron/v3"
+
+	"github.com/fish-not-phish/FnBox/backend/functions/docker/go/sandbox"
+)
+
+// EventSource is a pluggable trigger that invokes a loaded function outside
+// the synchronous /invoke path. Start binds/schedules the source and returns
+// once it's ready, doing its ongoing work (accepting connections, firing on
+// schedule, watching paths) in its own goroutine; Stop tears it down and is
+// safe to call more than once.
+type EventSource interface {
+	Start(ctx context.Context) error
+	Stop()
+}
+
+const defaultEventTimeoutSeconds = 30
+
+// dispatchEvent fires event at the latest loaded version of name, routing
+// through the same executeFunction path /invoke uses so sandboxing and
+// metrics stay uniform. Event sources are fire-and-forget: the result is
+// logged, not returned to a caller.
+func dispatchEvent(name string, event map[string]interface{}) {
+	entry, ok := registry.Latest(name)
+	if !ok {
+		log.Printf("[EVENTS] dispatch to '%s': no loaded function\n", name)
+		return
+	}
+
+	result := executeFunction(entry, event, defaultEventTimeoutSeconds, sandbox.Limits{})
+	if !result.Success {
+		log.Printf("[EVENTS] '%s' invocation failed: %s\n", name, result.Error)
+	}
+}
+
+// TCPSource accepts line-delimited JSON events on Port and dispatches each
+// line to Function.
+type TCPSource struct {
+	Port     int
+	Function string
+
+	mu       sync.Mutex
+	listener net.Listener
+	closed   bool
+}
+
+func NewTCPSource(port int, function string) *TCPSource {
+	return &TCPSource{Port: port, Function: function}
+}
+
+func (s *TCPSource) Start(ctx context.Context) error {
+	ln, err := net.Listen("tcp", fmt.Sprintf(":%d", s.Port))
+	if err != nil {
+		return fmt.Errorf("tcp source: %w", err)
+	}
+
+	s.mu.Lock()
+	s.listener = ln
+	s.mu.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		s.Stop()
+	}()
+
+	go s.acceptLoop(ln)
+
+	return nil
+}
+
+func (s *TCPSource) acceptLoop(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if s.isClosed() {
+				return
+			}
+			log.Printf("[EVENTS] tcp source %s: accept: %v\n", s.Function, err)
+			continue
+		}
+		go s.handleConn(conn)
+	}
+}
+
+func (s *TCPSource) handleConn(conn net.Conn) {
+	defer conn.Close()
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("[EVENTS] tcp source %s: recovered from panic: %v\n", s.Function, r)
+		}
+	}()
+
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+
+		var event map[string]interface{}
+		if err := json.Unmarshal(line, &event); err != nil {
+			log.Printf("[EVENTS] tcp source %s: invalid JSON: %v\n", s.Function, err)
+			continue
+		}
+
+		dispatchEvent(s.Function, event)
+	}
+}
+
+func (s *TCPSource) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+func (s *TCPSource) Stop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	s.closed = true
+	if s.listener != nil {
+		s.listener.Close()
+	}
+}
+
+// CronSource fires an empty event at Function on Schedule (a standard
+// five-field cron expression).
+type CronSource struct {
+	Schedule string
+	Function string
+
+	c *cron.Cron
+}
+
+func NewCronSource(schedule, function string) *CronSource {
+	return &CronSource{Schedule: schedule, Function: function}
+}
+
+func (s *CronSource) Start(ctx context.Context) error {
+	s.c = cron.New()
+	_, err := s.c.AddFunc(s.Schedule, func() {
+		dispatchEvent(s.Function, map[string]interface{}{})
+	})
+	if err != nil {
+		return fmt.Errorf("cron source: invalid schedule %q: %w", s.Schedule, err)
+	}
+
+	s.c.Start()
+
+	go func() {
+		<-ctx.Done()
+		s.Stop()
+	}()
+
+	return nil
+}
+
+func (s *CronSource) Stop() {
+	if s.c != nil {
+		s.c.Stop()
+	}
+}
+
+// FSWatchSource emits a {path, op} event at Function for every change under
+// Path.
+type FSWatchSource struct {
+	Path     string
+	Function string
+
+	watcher *fsnotify.Watcher
+}
+
+func NewFSWatchSource(path, function string) *FSWatchSource {
+	return &FSWatchSource{Path: path, Function: function}
+}
+
+func (s *FSWatchSource) Start(ctx context.Context) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("fswatch source: %w", err)
+	}
+
+	if err := watcher.Add(s.Path); err != nil {
+		watcher.Close()
+		return fmt.Errorf("fswatch source: watching %s: %w", s.Path, err)
+	}
+
+	s.watcher = watcher
+
+	go func() {
+		defer watcher.Close()
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				dispatchEvent(s.Function, map[string]interface{}{
+					"path": event.Name,
+					"op":   event.Op.String(),
+				})
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.Printf("[EVENTS] fswatch source %s: %v\n", s.Function, err)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return nil
+}
+
+func (s *FSWatchSource) Stop() {
+	if s.watcher != nil {
+		s.watcher.Close()
+	}
+}
+
+// sourceHandle is one running EventSource registered via /sources.
+type sourceHandle struct {
+	id     string
+	kind   string
+	source EventSource
+	cancel context.CancelFunc
+}
+
+// SourceManager keeps every running EventSource resident so it can be
+// started once and left running for the life of the agent, mirroring how
+// FunctionRegistry keeps loaded functions resident.
+type SourceManager struct {
+	mu      sync.Mutex
+	sources map[string]*sourceHandle
+}
+
+func NewSourceManager() *SourceManager {
+	return &SourceManager{sources: make(map[string]*sourceHandle)}
+}
+
+var sourceManager = NewSourceManager()
+
+// Add starts source and, if it starts cleanly, registers it under a new id.
+func (m *SourceManager) Add(kind string, source EventSource) (string, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	if err := source.Start(ctx); err != nil {
+		cancel()
+		return "", err
+	}
+
+	id := fmt.Sprintf("%s-%d", kind, time.Now().UnixNano())
+
+	m.mu.Lock()
+	m.sources[id] = &sourceHandle{id: id, kind: kind, source: source, cancel: cancel}
+	m.mu.Unlock()
+
+	return id, nil
+}
+
+type SourceRequest struct {
+	Type     string                 `json:"type"`
+	Config   map[string]interface{} `json:"config"`
+	Function string                 `json:"function"`
+}
+
+type SourceResponse struct {
+	Success bool   `json:"success"`
+	ID      string `json:"id"`
+	Message string `json:"message"`
+}
+
+func sourcesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req SourceRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		sendError(w, http.StatusBadRequest, "Invalid JSON")
+		return
+	}
+
+	if req.Function == "" {
+		sendError(w, http.StatusBadRequest, "Missing 'function' field")
+		return
+	}
+
+	source, err := buildEventSource(req.Type, req.Config, req.Function)
+	if err != nil {
+		sendError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	id, err := sourceManager.Add(req.Type, source)
+	if err != nil {
+		sendError(w, http.StatusInternalServerError, fmt.Sprintf("starting source: %v", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(SourceResponse{
+		Success: true,
+		ID:      id,
+		Message: "Source started",
+	})
+}
+
+// buildEventSource constructs the EventSource named by kind, reading its
+// config in the shape each adapter expects.
+func buildEventSource(kind string, config map[string]interface{}, function string) (EventSource, error) {
+	switch kind {
+	case "tcp":
+		port, ok := config["port"].(float64)
+		if !ok {
+			return nil, fmt.Errorf("tcp source requires numeric 'port' in config")
+		}
+		return NewTCPSource(int(port), function), nil
+
+	case "cron":
+		schedule, ok := config["schedule"].(string)
+		if !ok || schedule == "" {
+			return nil, fmt.Errorf("cron source requires 'schedule' in config")
+		}
+		return NewCronSource(schedule, function), nil
+
+	case "fswatch":
+		path, ok := config["path"].(string)
+		if !ok || path == "" {
+			return nil, fmt.Errorf("fswatch source requires 'path' in config")
+		}
+		return NewFSWatchSource(path, function), nil
+
+	default:
+		return nil, fmt.Errorf("unknown source type %q (want tcp, cron, or fswatch)", kind)
+	}
+}
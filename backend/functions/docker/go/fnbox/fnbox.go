@@ -0,0 +1,131 @@
+// Package fnbox defines the context contract FnBox hands to every function
+// handler: a context.Context carrying the invocation's deadline, request ID,
+// and memory budget, so handlers can call ctx.Deadline() to bail out of a
+// long DB query or HTTP call before FnBox kills them anyway.
+package fnbox
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+type contextKey string
+
+const (
+	// Deadline holds the same time.Time the context's own Deadline()
+	// reports; some handlers prefer to read it directly with ctx.Value.
+	Deadline contextKey = "fnbox.deadline"
+	// RequestID identifies one invocation, for correlating handler logs
+	// with FnBox's own.
+	RequestID contextKey = "fnbox.request_id"
+	// MemoryLimitMB is the sandbox memory ceiling in effect for this
+	// invocation, in megabytes, or 0 if unconstrained.
+	MemoryLimitMB contextKey = "fnbox.memory_limit_mb"
+)
+
+// DeadlineContext is a context.Context whose deadline can be pushed out
+// in place instead of rebuilding the context tree, modeled on the gvisor
+// netstack gonet adapter's deadlineTimer: a single done channel closed by a
+// time.AfterFunc on expiry, re-armed by Reset.
+type DeadlineContext struct {
+	context.Context
+
+	mu       sync.Mutex
+	deadline time.Time
+	timer    *time.Timer
+	done     chan struct{}
+	err      error
+}
+
+// NewContext returns a DeadlineContext wrapping parent, carrying deadline,
+// requestID, and memoryLimitMB as values and closing Done() when deadline
+// passes or parent is done, whichever comes first.
+func NewContext(parent context.Context, deadline time.Time, requestID string, memoryLimitMB int64) *DeadlineContext {
+	values := context.WithValue(parent, RequestID, requestID)
+	values = context.WithValue(values, MemoryLimitMB, memoryLimitMB)
+	values = context.WithValue(values, Deadline, deadline)
+
+	d := &DeadlineContext{Context: values, done: make(chan struct{})}
+	d.Reset(deadline)
+
+	go func(done chan struct{}) {
+		select {
+		case <-parent.Done():
+			d.mu.Lock()
+			if d.err == nil {
+				d.err = parent.Err()
+				close(done)
+			}
+			d.mu.Unlock()
+		case <-done:
+		}
+	}(d.done)
+
+	return d
+}
+
+func (d *DeadlineContext) Deadline() (time.Time, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.deadline, true
+}
+
+func (d *DeadlineContext) Done() <-chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.done
+}
+
+func (d *DeadlineContext) Err() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.err
+}
+
+// Reset re-arms the expiry timer against a new deadline. If Done() had
+// already closed, Reset replaces it with a fresh channel and clears Err().
+func (d *DeadlineContext) Reset(deadline time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.timer != nil {
+		d.timer.Stop()
+	}
+
+	select {
+	case <-d.done:
+		d.done = make(chan struct{})
+	default:
+	}
+
+	d.deadline = deadline
+	d.err = nil
+
+	done := d.done
+	d.timer = time.AfterFunc(time.Until(deadline), func() {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		if d.err == nil {
+			d.err = context.DeadlineExceeded
+			close(done)
+		}
+	})
+}
+
+// Stop releases the expiry timer and closes done, so the parent-watcher
+// goroutine started in NewContext exits instead of blocking on a parent
+// that may never finish (e.g. context.Background()). Callers should defer
+// it once the invocation it guards has finished, the same way they'd defer
+// a context.CancelFunc.
+func (d *DeadlineContext) Stop() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.timer != nil {
+		d.timer.Stop()
+	}
+	if d.err == nil {
+		d.err = context.Canceled
+		close(d.done)
+	}
+}
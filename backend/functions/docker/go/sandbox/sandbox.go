@@ -0,0 +1,217 @@
+// Package sandbox isolates a single compiled function invocation behind a
+// cgroup v2 slice and a seccomp-bpf filter, so user code can't exceed its
+// requested memory/CPU/pid budget or touch host-level syscalls.
+package sandbox
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Mode selects how aggressively an invocation is isolated. ModeNone is a
+// plain exec, for machines without cgroups v2 (e.g. non-Linux dev boxes);
+// under ModeCgroup and ModeFull, Prepare returns an error when the cgroup
+// cannot be set up, with no fallback to a plain exec.
+type Mode string
+
+const (
+	ModeNone   Mode = "none"
+	ModeCgroup Mode = "cgroup"
+	ModeFull   Mode = "full"
+)
+
+func ParseMode(s string) (Mode, error) {
+	switch Mode(s) {
+	case ModeNone, ModeCgroup, ModeFull:
+		return Mode(s), nil
+	default:
+		return "", fmt.Errorf("sandbox: unknown mode %q (want none, cgroup, or full)", s)
+	}
+}
+
+const cgroupRoot = "/sys/fs/cgroup/fnbox"
+
+// delegatedControllers are enabled on the cgroup root and on cgroupRoot
+// itself so that per-invocation leaf cgroups created under it actually get
+// memory.max/cpu.max/pids.max interface files -- under cgroup v2 a child
+// only gains a controller's control files once its parent has delegated
+// that controller via its own cgroup.subtree_control.
+var delegatedControllers = []string{"memory", "cpu", "pids"}
+
+var delegateOnce sync.Once
+var delegateErr error
+
+// ensureDelegation enables delegatedControllers on "/sys/fs/cgroup" and on
+// cgroupRoot, creating cgroupRoot if needed. It runs once per process since
+// the delegation only needs to happen before the first invocation.
+func ensureDelegation() error {
+	delegateOnce.Do(func() {
+		if err := enableControllers("/sys/fs/cgroup"); err != nil {
+			delegateErr = fmt.Errorf("sandbox: delegating controllers at cgroup root: %w", err)
+			return
+		}
+
+		if err := os.MkdirAll(cgroupRoot, 0755); err != nil {
+			delegateErr = fmt.Errorf("sandbox: creating %s: %w", cgroupRoot, err)
+			return
+		}
+
+		if err := enableControllers(cgroupRoot); err != nil {
+			delegateErr = fmt.Errorf("sandbox: delegating controllers at %s: %w", cgroupRoot, err)
+			return
+		}
+	})
+	return delegateErr
+}
+
+// enableControllers writes +memory +cpu +pids to dir's subtree_control so
+// cgroups created underneath it get those controllers' control files.
+func enableControllers(dir string) error {
+	value := "+" + strings.Join(delegatedControllers, " +")
+	return os.WriteFile(filepath.Join(dir, "cgroup.subtree_control"), []byte(value), 0644)
+}
+
+// Limits are the per-invoke resource ceilings carried on InvokeRequest.
+// A zero value leaves the corresponding control file untouched.
+type Limits struct {
+	MemoryLimitMb int64
+	CpuMillicores int64
+	MaxPids       int
+}
+
+// Sandbox owns one execution's cgroup v2 slice.
+type Sandbox struct {
+	Mode       Mode
+	ExecID     string
+	CgroupPath string
+	Limits     Limits
+}
+
+func New(mode Mode, execID string, limits Limits) *Sandbox {
+	return &Sandbox{
+		Mode:       mode,
+		ExecID:     execID,
+		CgroupPath: filepath.Join(cgroupRoot, execID),
+		Limits:     limits,
+	}
+}
+
+// Prepare creates the cgroup and writes its resource limits. A no-op under
+// ModeNone.
+func (s *Sandbox) Prepare() error {
+	if s.Mode == ModeNone {
+		return nil
+	}
+
+	if err := ensureDelegation(); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(s.CgroupPath, 0755); err != nil {
+		return fmt.Errorf("sandbox: creating cgroup: %w", err)
+	}
+
+	if s.Limits.MemoryLimitMb > 0 {
+		if err := s.writeControl("memory.max", strconv.FormatInt(s.Limits.MemoryLimitMb*1024*1024, 10)); err != nil {
+			return err
+		}
+		// Disable swap so memory pressure shows up as a hard kill, not a slowdown.
+		if err := s.writeControl("memory.swap.max", "0"); err != nil {
+			return err
+		}
+	}
+
+	if s.Limits.CpuMillicores > 0 {
+		// cpu.max is "<quota> <period>" in microseconds; a 100ms period keeps
+		// the math in whole microseconds for any millicore value >= 10.
+		const periodUs = int64(100000)
+		quotaUs := s.Limits.CpuMillicores * periodUs / 1000
+		if err := s.writeControl("cpu.max", fmt.Sprintf("%d %d", quotaUs, periodUs)); err != nil {
+			return err
+		}
+	}
+
+	if s.Limits.MaxPids > 0 {
+		if err := s.writeControl("pids.max", strconv.Itoa(s.Limits.MaxPids)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Adopt moves pid into the sandbox's cgroup. Call once the child has
+// started so its PID is known.
+func (s *Sandbox) Adopt(pid int) error {
+	if s.Mode == ModeNone {
+		return nil
+	}
+	return s.writeControl("cgroup.procs", strconv.Itoa(pid))
+}
+
+// PeakMemoryMb reads memory.peak for the invocation -- the authoritative
+// figure to report instead of estimating from the agent's own MemStats.
+func (s *Sandbox) PeakMemoryMb() (int64, error) {
+	if s.Mode == ModeNone {
+		return 0, nil
+	}
+
+	data, err := os.ReadFile(filepath.Join(s.CgroupPath, "memory.peak"))
+	if err != nil {
+		return 0, err
+	}
+
+	peak, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return 0, err
+	}
+
+	return peak / (1024 * 1024), nil
+}
+
+// OOMKilled reports whether the kernel OOM-killed anything in this cgroup.
+func (s *Sandbox) OOMKilled() bool {
+	if s.Mode == ModeNone {
+		return false
+	}
+
+	data, err := os.ReadFile(filepath.Join(s.CgroupPath, "memory.events"))
+	if err != nil {
+		return false
+	}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		if fields[0] != "oom_kill" && fields[0] != "oom" {
+			continue
+		}
+		if n, err := strconv.Atoi(fields[1]); err == nil && n > 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Cleanup removes the cgroup. Safe to call even if Prepare was never called
+// or failed partway through.
+func (s *Sandbox) Cleanup() {
+	if s.Mode == ModeNone {
+		return
+	}
+	os.RemoveAll(s.CgroupPath)
+}
+
+func (s *Sandbox) writeControl(file, value string) error {
+	if err := os.WriteFile(filepath.Join(s.CgroupPath, file), []byte(value), 0644); err != nil {
+		return fmt.Errorf("sandbox: writing %s: %w", file, err)
+	}
+	return nil
+}
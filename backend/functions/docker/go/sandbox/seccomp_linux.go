@@ -0,0 +1,48 @@
+//go:build linux
+
+package sandbox
+
+import (
+	seccomp "github.com/seccomp/libseccomp-golang"
+)
+
+// deniedSyscalls have no legitimate use inside a sandboxed function and are
+// blocked outright under ModeFull.
+var deniedSyscalls = []string{
+	"mount",
+	"umount2",
+	"ptrace",
+	"reboot",
+	"kexec_load",
+	"kexec_file_load",
+	"pivot_root",
+	"swapon",
+	"swapoff",
+}
+
+// InstallSeccompFilter applies a default-allow filter that denies
+// deniedSyscalls. It must be called by the sandboxed process itself -- the
+// agent's re-exec trampoline calls it before it execs into the compiled
+// function binary -- since a seccomp filter can only be installed on the
+// calling process, not a sibling one.
+func InstallSeccompFilter() error {
+	filter, err := seccomp.NewFilter(seccomp.ActAllow)
+	if err != nil {
+		return err
+	}
+	defer filter.Release()
+
+	for _, name := range deniedSyscalls {
+		call, err := seccomp.GetSyscallFromName(name)
+		if err != nil {
+			// Not every kernel/arch exposes every syscall name; skip rather
+			// than fail the whole filter over one missing call.
+			continue
+		}
+		if err := filter.AddRule(call, seccomp.ActErrno.SetReturnCode(1)); err != nil {
+			return err
+		}
+	}
+
+	return filter.Load()
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package sandbox
+
+// InstallSeccompFilter is a no-op off Linux; ModeFull degrades to ModeCgroup
+// there since seccomp-bpf is Linux-specific.
+func InstallSeccompFilter() error {
+	return nil
+}